@@ -0,0 +1,190 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	postsStreamName = "OSCON2019_CHAT"
+	replayWindow    = 24 * time.Hour
+	replayIdle      = 250 * time.Millisecond
+
+	addSubjectAttempts = 5
+)
+
+// setupJetStream binds to (or creates) the stream backing chat history,
+// replays anything we missed, and leaves s.js set so sendPost can publish
+// with ack tracking. Live delivery is still handled by the core-NATS
+// subscriptions set up in setupNATS.
+func (s *state) setupJetStream(nc *nats.Conn) error {
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("connecting to JetStream: %v", err)
+	}
+
+	dmsSub := fmt.Sprintf(dmsPub, s.me.Subject)
+	cfg := &nats.StreamConfig{
+		Name:     postsStreamName,
+		Subjects: []string{postsSub, dmsSub},
+		MaxAge:   replayWindow,
+	}
+	if _, err := js.AddStream(cfg); err != nil {
+		// Most likely the stream already exists from a prior session with
+		// a different DM subject; add ours to the existing config.
+		if err := addStreamSubject(js, postsStreamName, dmsSub); err != nil {
+			return fmt.Errorf("adding our DM subject to the stream: %v", err)
+		}
+	}
+
+	s.js = js
+
+	if err := s.replay(postsSub, s.processNewPost); err != nil {
+		log.Printf("-ERR Replaying posts: %v", err)
+	}
+	if err := s.replay(dmsSub, s.processNewDM); err != nil {
+		log.Printf("-ERR Replaying DMs: %v", err)
+	}
+
+	return nil
+}
+
+// addStreamSubject adds subj to the named stream's subject list. UpdateStream
+// has no compare-and-swap semantics — a concurrent writer can still clobber
+// our change after we've read a stale config, and UpdateStream itself
+// reports no error when that happens. So each attempt re-reads StreamInfo
+// immediately before its UpdateStream to keep the read-modify-write window
+// small, and then re-reads StreamInfo again afterwards to verify subj
+// actually stuck; if another client's write raced ours and dropped it, that
+// shows up as a verification failure and we retry the whole cycle.
+func addStreamSubject(js nats.JetStreamContext, name, subj string) error {
+	var lastErr error
+	for i := 0; i < addSubjectAttempts; i++ {
+		info, err := js.StreamInfo(name)
+		if err != nil {
+			return err
+		}
+		if containsSubject(info.Config.Subjects, subj) {
+			return nil
+		}
+
+		cfg := info.Config
+		cfg.Subjects = append(append([]string{}, cfg.Subjects...), subj)
+		if _, err := js.UpdateStream(&cfg); err != nil {
+			lastErr = err
+			continue
+		}
+
+		// UpdateStream reported success, but that's no guarantee our
+		// subject is still there if someone else wrote in between our
+		// read and our write. Verify before declaring victory.
+		verify, err := js.StreamInfo(name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if containsSubject(verify.Config.Subjects, subj) {
+			return nil
+		}
+		lastErr = fmt.Errorf("subject was dropped by a concurrent update")
+	}
+	return fmt.Errorf("giving up after %d attempts, last error: %v", addSubjectAttempts, lastErr)
+}
+
+func containsSubject(subjects []string, subj string) bool {
+	for _, s := range subjects {
+		if s == subj {
+			return true
+		}
+	}
+	return false
+}
+
+// replay drains an ephemeral ordered consumer over subj from replayWindow
+// ago up to now, feeding each message to handler, then unsubscribes so the
+// caller's live core-NATS subscription takes over from here.
+func (s *state) replay(subj string, handler nats.MsgHandler) error {
+	sub, err := s.js.SubscribeSync(subj,
+		nats.OrderedConsumer(),
+		nats.StartTime(time.Now().Add(-replayWindow)),
+	)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		m, err := sub.NextMsg(replayIdle)
+		if err != nil {
+			// Timed out waiting for the next message, i.e. we've caught up.
+			return nil
+		}
+		handler(m)
+	}
+}
+
+// ackJS acks m if it was delivered by JetStream; it is a no-op for plain
+// core-NATS deliveries. Called up front by the post/DM handlers so replay
+// and redelivered messages don't linger un-acked on the consumer.
+func ackJS(m *nats.Msg) {
+	if strings.HasPrefix(m.Reply, "$JS.ACK.") {
+		m.Ack()
+	}
+}
+
+// deliveryStatus is the outcome of a JetStream-published post's ack, kept
+// around so the UI can render a delivery indicator next to the post.
+type deliveryStatus int
+
+const (
+	deliveryPending deliveryStatus = iota
+	deliveryOK
+	deliveryFailed
+)
+
+// trackPubAck waits for the JetStream publish ack for post id, records the
+// outcome, and asks the UI to redraw that post's delivery marker.
+func (s *state) trackPubAck(id string, future nats.PubAckFuture) {
+	select {
+	case <-future.Ok():
+		s.setDeliveryState(id, deliveryOK)
+	case err := <-future.Err():
+		log.Printf("-ERR Publish ack failed for post %s: %v", id, err)
+		s.setDeliveryState(id, deliveryFailed)
+	case <-time.After(5 * time.Second):
+		log.Printf("-ERR Publish ack timed out for post %s", id)
+		s.setDeliveryState(id, deliveryFailed)
+	}
+}
+
+// setDeliveryState records id's publish outcome and asks the UI to redraw
+// its delivery marker (e.g. a checkmark vs. a failure indicator).
+func (s *state) setDeliveryState(id string, status deliveryStatus) {
+	s.Lock()
+	if s.deliveryState == nil {
+		s.deliveryState = make(map[string]deliveryStatus)
+	}
+	s.deliveryState[id] = status
+	s.Unlock()
+
+	s.ui.Update(func() {
+		s.renderDeliveryState(id, status)
+	})
+}
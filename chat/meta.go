@@ -0,0 +1,185 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	metaChannelSub = preSub + "meta.*"
+	metaChannelPub = preSub + "meta.%s"
+	metaDMPub      = preSub + "meta.dms.%s"
+
+	typingType = jwt.ClaimType("ngs-chat-typing")
+	readType   = jwt.ClaimType("ngs-chat-read")
+
+	typingExpiry   = 3 * time.Second
+	typingDebounce = 1 * time.Second
+
+	postTagPrefix = "post:"
+)
+
+// setupMeta subscribes to the high-frequency, low-value typing/read-receipt
+// traffic. These claims expire in seconds and are never persisted.
+func (s *state) setupMeta() {
+	if _, err := s.nc.Subscribe(metaChannelSub, s.processChannelMeta); err != nil {
+		log.Printf("-ERR Could not subscribe to channel meta: %v", err)
+	}
+	dmMetaSub := fmt.Sprintf(metaDMPub, s.me.Subject)
+	if _, err := s.nc.Subscribe(dmMetaSub, s.processDMMeta); err != nil {
+		log.Printf("-ERR Could not subscribe to DM meta: %v", err)
+	}
+}
+
+// sendTyping announces that we're typing in the current channel or DM
+// view, debounced to at most one publish per second so a burst of
+// keystrokes costs one message.
+func (s *state) sendTyping() {
+	s.Lock()
+	if time.Since(s.lastTypingSent) < typingDebounce {
+		s.Unlock()
+		return
+	}
+	s.lastTypingSent = time.Now()
+
+	var subj string
+	if s.cur.kind == direct {
+		if u := s.dms[s.cur.name]; u != nil {
+			subj = fmt.Sprintf(metaDMPub, u.nkey)
+		}
+	} else {
+		subj = fmt.Sprintf(metaChannelPub, s.cur.name)
+	}
+	s.Unlock()
+
+	if subj == "" {
+		return
+	}
+
+	typing := jwt.NewGenericClaims(s.me.Subject)
+	typing.Name = s.name
+	typing.Expires = time.Now().Add(typingExpiry).UTC().Unix()
+	typing.Type = typingType
+	tjwt, err := typing.Encode(s.skp)
+	if err != nil {
+		return
+	}
+	s.nc.Publish(subj, []byte(tjwt))
+}
+
+// sendReadReceipt announces that postID has become visible in the current
+// channel or DM view, and persists it as our read position for that view
+// so a future session resumes from here.
+func (s *state) sendReadReceipt(postID string) {
+	readKey := s.cur.name
+	var subj string
+	if s.cur.kind == direct {
+		if u := s.dms[s.cur.name]; u != nil {
+			subj = fmt.Sprintf(metaDMPub, u.nkey)
+			readKey = "dm:" + s.cur.name
+		}
+	} else {
+		subj = fmt.Sprintf(metaChannelPub, s.cur.name)
+	}
+	if subj == "" {
+		return
+	}
+
+	read := jwt.NewGenericClaims(s.me.Subject)
+	read.Name = s.name
+	read.Expires = time.Now().Add(typingExpiry).UTC().Unix()
+	read.Type = readType
+	read.Tags.Add(postTagPrefix + postID)
+	rjwt, err := read.Encode(s.skp)
+	if err != nil {
+		return
+	}
+	s.nc.Publish(subj, []byte(rjwt))
+
+	s.recordChannelRead(readKey, postID)
+}
+
+// processChannelMeta handles typing/read traffic for a channel, recovering
+// the channel name from the subject it arrived on.
+func (s *state) processChannelMeta(m *nats.Msg) {
+	chanName := strings.TrimPrefix(m.Subject, preSub+"meta.")
+	s.handleMeta(chanName, false, m)
+}
+
+// processDMMeta handles typing/read traffic sent to our DM meta subject.
+func (s *state) processDMMeta(m *nats.Msg) {
+	s.handleMeta("", true, m)
+}
+
+func (s *state) handleMeta(chanName string, isDM bool, m *nats.Msg) {
+	claim, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil {
+		log.Printf("-ERR Received a bad meta update: %v", err)
+		return
+	}
+	vr := jwt.CreateValidationResults()
+	claim.Validate(vr)
+	if vr.IsBlocking(true) {
+		log.Printf("-ERR Blocking issues for meta update:%+v", vr)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	u := s.users[claim.Subject]
+	if u == nil {
+		return
+	}
+
+	switch claim.Type {
+	case typingType:
+		u.typingUntil = time.Now().Add(typingExpiry)
+		if (isDM && s.cur.kind == direct && s.cur.name == u.name) ||
+			(!isDM && s.cur.kind == channel && s.cur.name == chanName) {
+			s.ui.Update(func() {
+				s.renderTypingStatus(u.name, u.typingUntil)
+			})
+		}
+
+	case readType:
+		postID := postIDFromTags(claim.Tags)
+		if postID == "" {
+			return
+		}
+		u.lastReadID = postID
+		if isDM && s.cur.kind == direct && s.cur.name == u.name {
+			s.ui.Update(func() {
+				s.renderReadReceipt(u.name, postID)
+			})
+		}
+	}
+}
+
+// postIDFromTags pulls the post ID out of a read-receipt claim's tags.
+func postIDFromTags(tags jwt.TagList) string {
+	for _, t := range tags {
+		if strings.HasPrefix(string(t), postTagPrefix) {
+			return strings.TrimPrefix(string(t), postTagPrefix)
+		}
+	}
+	return ""
+}
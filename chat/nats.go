@@ -14,6 +14,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -36,9 +37,15 @@ const (
 )
 
 // This will setup our subscriptions for the chat service.
-func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
+func (s *state) setupNATS(nc *nats.Conn, creds, name string, useJS bool) {
 	s.nc = nc
 	s.me, s.skp = loadUser(creds)
+	s.ckp = loadOrCreateCurveKeys(creds)
+	if pub, err := s.ckp.PublicKey(); err == nil {
+		s.myXKey = pub
+	} else {
+		log.Printf("-ERR Could not read our own curve public key: %v", err)
+	}
 
 	// Allow override
 	if name != "" {
@@ -47,6 +54,32 @@ func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
 		s.name = displayName(s.me.Name)
 	}
 
+	// Open our durable metadata bucket (or an in-memory fallback) and
+	// hydrate known users/channels from it before we subscribe live, so a
+	// restart doesn't start from a blank DM list.
+	s.store = s.openStore(nc)
+	s.hydrateFromStore()
+	if err := s.store.Watch(s.applyStoredKey); err != nil {
+		log.Printf("-ERR Could not watch metadata store: %v", err)
+	}
+
+	// Answer whois requests and do an initial scatter/gather so we have
+	// presence (and cached xkeys) for everyone online now, rather than
+	// waiting up to onlineInterval/2 for their next heartbeat.
+	s.setupWhois()
+
+	// If the server supports JetStream, bind to (or create) the stream
+	// backing history and replay anything we missed before we subscribe
+	// live. This runs after the store hydrate and whois gather above so
+	// replayed DMs, which are sealed, have a cached sender xkey to open
+	// instead of being buffered as coming from an "unknown or keyless
+	// sender". Falls back to core NATS on any error.
+	if useJS {
+		if err := s.setupJetStream(nc); err != nil {
+			log.Printf("-ERR JetStream unavailable, falling back to core NATS: %v", err)
+		}
+	}
+
 	// Listen for new posts, direct msgs.
 	if _, err := nc.Subscribe(postsSub, s.processNewPost); err != nil {
 		log.Fatalf("Could not subscribe to new posts: %v", err)
@@ -63,6 +96,9 @@ func (s *state) setupNATS(nc *nats.Conn, creds, name string) {
 		log.Fatalf("Could not subscribe to online status: %v", err)
 	}
 
+	// Listen for typing indicators and read receipts.
+	s.setupMeta()
+
 	// Set our status to online.
 	s.sendFirstOnlineStatus()
 
@@ -97,6 +133,9 @@ func (s *state) sendOnlineStatus(first bool) {
 	online.Name = s.name
 	online.Expires = time.Now().Add(onlineInterval).UTC().Unix() // 1 minute from now
 	online.Type = jwt.ClaimType("ngs-chat-online")
+	if s.myXKey != "" {
+		online.Tags.Add(xkeyTagPrefix + s.myXKey)
+	}
 	if first {
 		online.Tags.Add("new")
 	}
@@ -132,6 +171,11 @@ func (s *state) processUserUpdate(m *nats.Msg) {
 	}
 	u.last = time.Now()
 
+	if xkey := xkeyFromTags(userClaim.Tags); xkey != "" {
+		u.xkey = xkey
+	}
+	s.persistUser(u)
+
 	if userClaim.Tags.Contains("new") {
 		// Now send out status as well so they know us before next update.
 		s.sendOnlineStatus(false)
@@ -154,11 +198,126 @@ func (s *state) postSubject() string {
 func (s *state) sendPost(m string) *postClaim {
 	newPost := s.newPost(m)
 	pjwt, _ := newPost.Encode(s.skp)
+	payload := []byte(pjwt)
+
+	// Seal DMs to the recipient's curve key when we know it. If they
+	// haven't advertised one yet, fall back to the existing plaintext JWT.
+	if s.cur.kind == direct {
+		if u := s.dms[s.cur.name]; u != nil && u.xkey != "" {
+			sealed, err := s.ckp.Seal(payload, u.xkey)
+			if err != nil {
+				log.Printf("-ERR Could not seal DM for %s, sending in plaintext: %v", u.name, err)
+			} else {
+				payload = sealEnvelope(s.me.Subject, sealed)
+			}
+		}
+	} else {
+		// Posting in a channel is our join signal: persist it so it's
+		// rejoined automatically next launch.
+		s.recordJoinedChannel(s.cur.name)
+	}
+
 	s.registerPost(newPost.ID)
-	s.nc.Publish(s.postSubject(), []byte(pjwt))
+
+	if s.js != nil {
+		future, err := s.js.PublishAsync(s.postSubject(), payload)
+		if err != nil {
+			log.Printf("-ERR Could not publish post to JetStream: %v", err)
+			return newPost
+		}
+		go s.trackPubAck(newPost.ID, future)
+	} else {
+		s.nc.Publish(s.postSubject(), payload)
+	}
 	return newPost
 }
 
+const xkeyTagPrefix = "xkey:"
+
+// xkeyFromTags pulls an advertised curve public key out of an online-status
+// claim's tags, if present.
+func xkeyFromTags(tags jwt.TagList) string {
+	for _, t := range tags {
+		if strings.HasPrefix(string(t), xkeyTagPrefix) {
+			return strings.TrimPrefix(string(t), xkeyTagPrefix)
+		}
+	}
+	return ""
+}
+
+const sealedPrefix = "SEALED:"
+
+// sealEnvelope wraps a sealed-box payload with the sender's (public) nkey
+// subject so the recipient can find our advertised curve key to open it.
+func sealEnvelope(fromSubject string, sealed []byte) []byte {
+	return append([]byte(sealedPrefix+fromSubject+":"), sealed...)
+}
+
+// openEnvelope recognizes an envelope produced by sealEnvelope, returning
+// the sender's subject and the sealed payload. ok is false for a plain,
+// unsealed post.
+func openEnvelope(data []byte) (subject string, sealed []byte, ok bool) {
+	if !bytes.HasPrefix(data, []byte(sealedPrefix)) {
+		return "", nil, false
+	}
+	rest := data[len(sealedPrefix):]
+	idx := bytes.IndexByte(rest, ':')
+	if idx < 0 {
+		return "", nil, false
+	}
+	return string(rest[:idx]), rest[idx+1:], true
+}
+
+// maxPendingDMsPerSender bounds how many sealed DMs we'll buffer for a
+// single unresolved sender before dropping the oldest, so a burst from a
+// sender whose whois never resolves can't grow without bound.
+const maxPendingDMsPerSender = 20
+
+// bufferPendingDM stashes a sealed DM envelope we couldn't open yet because
+// we don't know subject's xkey, so it can be replayed once whois resolves
+// it instead of being silently dropped.
+func (s *state) bufferPendingDM(subject string, data []byte) {
+	cp := append([]byte(nil), data...)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pendingDMs == nil {
+		s.pendingDMs = make(map[string][][]byte)
+	}
+	pending := append(s.pendingDMs[subject], cp)
+	if len(pending) > maxPendingDMsPerSender {
+		pending = pending[len(pending)-maxPendingDMsPerSender:]
+	}
+	s.pendingDMs[subject] = pending
+}
+
+// takePendingDMs returns and clears any sealed DM envelopes buffered for
+// subject.
+func (s *state) takePendingDMs(subject string) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+
+	pending := s.pendingDMs[subject]
+	delete(s.pendingDMs, subject)
+	return pending
+}
+
+// markSeen records that we've delivered post id to the UI, returning true
+// if it was already seen. Unlike postIsDupe (which only covers posts we
+// sent), this also catches received posts redelivered by JetStream or
+// overlapping with replay.
+func (s *state) markSeen(id string) bool {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if s.seen[id] {
+		return true
+	}
+	s.seen[id] = true
+	return false
+}
+
 func checkPostClaim(claim string) *postClaim {
 	post, err := jwt.DecodeGeneric(claim)
 	if err != nil {
@@ -174,8 +333,12 @@ func checkPostClaim(claim string) *postClaim {
 	return &postClaim{post}
 }
 
-// Receive a new channel post from another user.
+// Receive a new channel post from another user. m may be a live core-NATS
+// delivery or a JetStream replay/redelivery; ackJS takes care of the
+// latter so the caller doesn't need to know which.
 func (s *state) processNewPost(m *nats.Msg) {
+	ackJS(m)
+
 	post := checkPostClaim(string(m.Data))
 	if post == nil || s.posts[post.Subject] == nil {
 		return
@@ -184,7 +347,10 @@ func (s *state) processNewPost(m *nats.Msg) {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.postIsDupe(post.ID) {
+	// postIsDupe covers posts we sent ourselves; markSeen additionally
+	// catches posts we've already received, which matters once replay
+	// and live delivery can overlap or JetStream redelivers.
+	if s.postIsDupe(post.ID) || s.markSeen(post.ID) {
 		return
 	}
 	s.posts[post.Subject] = append(s.posts[post.Subject], post)
@@ -198,7 +364,28 @@ func (s *state) processNewPost(m *nats.Msg) {
 
 // Receive a new channel post from another user.
 func (s *state) processNewDM(m *nats.Msg) {
-	post := checkPostClaim(string(m.Data))
+	ackJS(m)
+
+	data := m.Data
+	if subject, sealed, ok := openEnvelope(data); ok {
+		s.Lock()
+		sender := s.users[subject]
+		s.Unlock()
+		if sender == nil || sender.xkey == "" {
+			log.Printf("-ERR Received sealed DM from unknown or keyless sender %s, buffering for replay", subject)
+			s.bufferPendingDM(subject, data)
+			go s.whoisUser(subject)
+			return
+		}
+		opened, err := s.ckp.Open(sealed, sender.xkey)
+		if err != nil {
+			log.Printf("-ERR Could not open sealed DM from %s: %v", sender.name, err)
+			return
+		}
+		data = opened
+	}
+
+	post := checkPostClaim(string(data))
 	if post == nil {
 		return
 	}
@@ -206,9 +393,15 @@ func (s *state) processNewDM(m *nats.Msg) {
 	s.Lock()
 	defer s.Unlock()
 
-	// We don't allow DMs from new users. We should know the user already.
+	// We don't allow DMs from new users. We should know the user already;
+	// if we don't, kick off a targeted whois so the next one isn't dropped.
 	u := s.users[post.Issuer]
 	if u == nil {
+		go s.whoisUser(post.Issuer)
+		return
+	}
+
+	if s.postIsDupe(post.ID) || s.markSeen(post.ID) {
 		return
 	}
 	u.posts = append(u.posts, post)
@@ -250,6 +443,36 @@ func loadUser(creds string) (*jwt.UserClaims, nkeys.KeyPair) {
 	return uc, kp
 }
 
+// curveKeysExt is appended to the creds path to name the file holding the
+// persisted curve25519 seed used for sealing/opening DMs.
+const curveKeysExt = ".xk"
+
+// loadOrCreateCurveKeys loads the curve keypair persisted alongside creds,
+// generating and persisting a new one on first run.
+func loadOrCreateCurveKeys(creds string) nkeys.KeyPair {
+	path := creds + curveKeysExt
+	if seed, err := ioutil.ReadFile(path); err == nil {
+		if ckp, err := nkeys.FromCurveSeed(seed); err == nil {
+			return ckp
+		} else {
+			log.Printf("-ERR Could not decode stored curve seed, regenerating: %v", err)
+		}
+	}
+
+	ckp, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		log.Fatalf("Could not generate curve keys: %v", err)
+	}
+	seed, err := ckp.Seed()
+	if err != nil {
+		log.Fatalf("Could not extract curve seed: %v", err)
+	}
+	if err := ioutil.WriteFile(path, seed, 0600); err != nil {
+		log.Printf("-ERR Could not persist curve seed to %s: %v", path, err)
+	}
+	return ckp
+}
+
 func setupConnOptions(opts []nats.Option) []nats.Option {
 	totalWait := 10 * time.Minute
 	reconnectDelay := time.Second
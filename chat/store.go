@@ -0,0 +1,308 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Store persists the metadata that would otherwise be lost across
+// restarts: known users, joined channels, and our last-read position in
+// each channel.
+type Store interface {
+	// Put stores value under key, overwriting any existing entry.
+	Put(key string, value []byte) error
+	// Get returns the current value for key, or nil if there isn't one.
+	Get(key string) ([]byte, error)
+	// Keys lists every key currently in the store, for hydration at
+	// startup.
+	Keys() ([]string, error)
+	// Watch calls fn for each Put to the store, including ones made by
+	// other concurrent sessions of the same user. The JetStream store
+	// also calls fn once for every key already present when Watch is
+	// called; the in-memory store never calls fn.
+	Watch(fn func(key string, value []byte)) error
+	// Close releases any resources held by the store.
+	Close()
+}
+
+const (
+	userKeyPrefix    = "user."
+	channelKeyPrefix = "channel."
+	readKeyPrefix    = "read."
+)
+
+// storedUser is the JSON shape we persist for each known user.
+type storedUser struct {
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+	XKey     string    `json:"xkey,omitempty"`
+}
+
+// jsStore is a Store backed by a JetStream key-value bucket.
+type jsStore struct {
+	kv nats.KeyValue
+}
+
+func newJSStore(js nats.JetStreamContext, bucket string) (Store, error) {
+	kv, err := js.KeyValue(bucket)
+	if err != nil {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &jsStore{kv: kv}, nil
+}
+
+func (s *jsStore) Put(key string, value []byte) error {
+	_, err := s.kv.Put(key, value)
+	return err
+}
+
+func (s *jsStore) Get(key string) ([]byte, error) {
+	entry, err := s.kv.Get(key)
+	if err == nats.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+func (s *jsStore) Keys() ([]string, error) {
+	keys, err := s.kv.Keys()
+	if err == nats.ErrNoKeysFound {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func (s *jsStore) Watch(fn func(key string, value []byte)) error {
+	w, err := s.kv.WatchAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for entry := range w.Updates() {
+			if entry == nil || entry.Operation() != nats.KeyValuePut {
+				continue
+			}
+			fn(entry.Key(), entry.Value())
+		}
+	}()
+	return nil
+}
+
+func (s *jsStore) Close() {}
+
+// memStore is an in-memory Store used when the server doesn't support
+// JetStream, so the demo still works against a plain NATS server.
+type memStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemStore() Store {
+	return &memStore{data: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	return nil
+}
+
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key], nil
+}
+
+func (s *memStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *memStore) Watch(fn func(key string, value []byte)) error { return nil }
+
+func (s *memStore) Close() {}
+
+// openStore opens our durable bucket, preferring JetStream KV and falling
+// back to an in-memory store if the server (or account) doesn't support it.
+func (s *state) openStore(nc *nats.Conn) Store {
+	bucket := fmt.Sprintf("ngs-chat-%s", s.me.Subject)
+
+	js := s.js
+	if js == nil {
+		if j, err := nc.JetStream(); err == nil {
+			js = j
+		}
+	}
+	if js != nil {
+		if store, err := newJSStore(js, bucket); err == nil {
+			return store
+		} else {
+			log.Printf("-ERR Could not open KV bucket %q, falling back to in-memory store: %v", bucket, err)
+		}
+	}
+	return newMemStore()
+}
+
+// hydrateFromStore seeds s.users/s.dms and our read positions from
+// whatever was persisted last time we ran.
+func (s *state) hydrateFromStore() {
+	keys, err := s.store.Keys()
+	if err != nil {
+		log.Printf("-ERR Could not list stored keys: %v", err)
+		return
+	}
+	for _, key := range keys {
+		val, err := s.store.Get(key)
+		if err != nil || val == nil {
+			continue
+		}
+		s.applyStoredKey(key, val)
+	}
+}
+
+// applyStoredKey applies a single key/value pair from the store, whether
+// found during hydration or pushed later by a Watch update from another
+// concurrent session of ours.
+func (s *state) applyStoredKey(key string, val []byte) {
+	switch {
+	case strings.HasPrefix(key, userKeyPrefix):
+		var su storedUser
+		if err := json.Unmarshal(val, &su); err != nil {
+			log.Printf("-ERR Could not decode stored user %s: %v", key, err)
+			return
+		}
+		subject := strings.TrimPrefix(key, userKeyPrefix)
+
+		s.Lock()
+		u := s.users[subject]
+		if u == nil {
+			u = s.addNewUser(su.Name, subject)
+		}
+		if su.LastSeen.After(u.last) {
+			u.last = su.LastSeen
+		}
+		if su.XKey != "" {
+			u.xkey = su.XKey
+		}
+		s.Unlock()
+
+	case strings.HasPrefix(key, channelKeyPrefix):
+		name := strings.TrimPrefix(key, channelKeyPrefix)
+		s.Lock()
+		s.joinChannel(name)
+		s.Unlock()
+
+	case strings.HasPrefix(key, readKeyPrefix):
+		channel := strings.TrimPrefix(key, readKeyPrefix)
+		s.Lock()
+		s.readPositions[channel] = string(val)
+		s.Unlock()
+	}
+}
+
+// persistUser writes u's current metadata to the store so it survives a
+// restart and is visible to other concurrent sessions of the same user.
+// Callers typically hold s.Lock() while calling this, so the actual
+// Store.Put (a network round trip against the JetStream KV backend) runs
+// in a goroutine rather than blocking the global state mutex; we snapshot
+// u's fields synchronously first since u may be mutated concurrently.
+func (s *state) persistUser(u *user) {
+	snap := storedUser{Name: u.name, LastSeen: u.last, XKey: u.xkey}
+	nkey := u.nkey
+
+	go func() {
+		val, err := json.Marshal(snap)
+		if err != nil {
+			return
+		}
+		if err := s.store.Put(userKeyPrefix+nkey, val); err != nil {
+			log.Printf("-ERR Could not persist user %s: %v", snap.Name, err)
+		}
+	}()
+}
+
+// recordJoinedChannel persists that we've joined channel so it's rejoined
+// automatically the next time we launch. Like persistUser, the Store.Put
+// runs off the caller's goroutine since it may be a network round trip.
+func (s *state) recordJoinedChannel(channel string) {
+	go func() {
+		if err := s.store.Put(channelKeyPrefix+channel, []byte(channel)); err != nil {
+			log.Printf("-ERR Could not persist joined channel %s: %v", channel, err)
+		}
+	}()
+}
+
+// readPersistDebounce bounds how often we'll write our read position for a
+// given channel to the store; scrolling through history shouldn't flood
+// the KV bucket with a Put per post.
+const readPersistDebounce = 2 * time.Second
+
+// recordChannelRead updates our in-memory read position for channel
+// immediately, and persists it to the store asynchronously and debounced,
+// since this is called on every post that scrolls into view.
+func (s *state) recordChannelRead(channel, postID string) {
+	s.Lock()
+	s.readPositions[channel] = postID
+
+	now := time.Now()
+	if s.lastReadPersist == nil {
+		s.lastReadPersist = make(map[string]time.Time)
+	}
+	if last, ok := s.lastReadPersist[channel]; ok && now.Sub(last) < readPersistDebounce {
+		// A write went out recently. Unless one is already queued, queue
+		// one for when the window closes so the latest position lands.
+		if !last.After(now) {
+			flushAt := last.Add(readPersistDebounce)
+			s.lastReadPersist[channel] = flushAt
+			time.AfterFunc(flushAt.Sub(now), func() {
+				s.Lock()
+				latest := s.readPositions[channel]
+				s.Unlock()
+				if err := s.store.Put(readKeyPrefix+channel, []byte(latest)); err != nil {
+					log.Printf("-ERR Could not persist read position for %s: %v", channel, err)
+				}
+			})
+		}
+		s.Unlock()
+		return
+	}
+	s.lastReadPersist[channel] = now
+	s.Unlock()
+
+	go func() {
+		if err := s.store.Put(readKeyPrefix+channel, []byte(postID)); err != nil {
+			log.Printf("-ERR Could not persist read position for %s: %v", channel, err)
+		}
+	}()
+}
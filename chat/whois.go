@@ -0,0 +1,161 @@
+// Copyright 2019 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	whoisPub       = preSub + "whois.%s"
+	whoisBroadcast = preSub + "whois.broadcast"
+	whoisType      = jwt.ClaimType("ngs-chat-whois")
+	whoisTimeout   = 500 * time.Millisecond
+)
+
+// setupWhois registers our per-user whois responder and does an initial
+// broadcast scatter/gather so we know who's online now, instead of waiting
+// up to onlineInterval/2 for everyone's next heartbeat.
+func (s *state) setupWhois() {
+	whoisSub := fmt.Sprintf(whoisPub, s.me.Subject)
+	if _, err := s.nc.Subscribe(whoisSub, s.respondWhois); err != nil {
+		log.Printf("-ERR Could not subscribe to whois requests: %v", err)
+		return
+	}
+	if _, err := s.nc.Subscribe(whoisBroadcast, s.respondWhois); err != nil {
+		log.Printf("-ERR Could not subscribe to whois broadcast: %v", err)
+		return
+	}
+
+	s.gatherWhois(whoisBroadcast, whoisTimeout)
+}
+
+// respondWhois answers a whois request (targeted or broadcast) with a
+// signed claim describing us, the same shape as an online-status update.
+func (s *state) respondWhois(m *nats.Msg) {
+	if m.Reply == "" {
+		return
+	}
+	who := jwt.NewGenericClaims(s.me.Subject)
+	who.Name = s.name
+	who.Expires = time.Now().Add(onlineInterval).UTC().Unix()
+	who.Type = whoisType
+	if s.myXKey != "" {
+		who.Tags.Add(xkeyTagPrefix + s.myXKey)
+	}
+	wjwt, err := who.Encode(s.skp)
+	if err != nil {
+		log.Printf("-ERR Could not encode whois reply: %v", err)
+		return
+	}
+	s.nc.Publish(m.Reply, []byte(wjwt))
+}
+
+// whoisUser issues a targeted whois request for subject and seeds s.users
+// from the reply, so a subsequent post or DM from them is recognized.
+func (s *state) whoisUser(subject string) {
+	s.gatherWhois(fmt.Sprintf(whoisPub, subject), whoisTimeout)
+}
+
+// gatherWhois publishes a whois request on subj via a dedicated inbox and
+// processes whatever replies arrive within wait, rather than a single
+// nc.RequestMsg call, since a broadcast can draw more than one reply.
+func (s *state) gatherWhois(subj string, wait time.Duration) {
+	inbox := nats.NewInbox()
+	sub, err := s.nc.SubscribeSync(inbox)
+	if err != nil {
+		log.Printf("-ERR Could not listen for whois replies: %v", err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	if err := s.nc.PublishRequest(subj, inbox, nil); err != nil {
+		log.Printf("-ERR Could not send whois request: %v", err)
+		return
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		m, err := sub.NextMsg(remaining)
+		if err != nil {
+			return
+		}
+		s.processWhoisReply(m)
+	}
+}
+
+// processWhoisReply validates a whois response and seeds/refreshes our
+// view of that user, same as processUserUpdate does for a heartbeat. If
+// this is the first time we've learned their xkey, any sealed DMs from
+// them that we buffered (because we couldn't open them yet) are replayed.
+func (s *state) processWhoisReply(m *nats.Msg) {
+	who, err := jwt.DecodeGeneric(string(m.Data))
+	if err != nil {
+		log.Printf("-ERR Received a bad whois reply: %v", err)
+		return
+	}
+	vr := jwt.CreateValidationResults()
+	who.Validate(vr)
+	if vr.IsBlocking(true) {
+		log.Printf("-ERR Blocking issues for whois reply:%+v", vr)
+		return
+	}
+
+	s.Lock()
+
+	u := s.users[who.Subject]
+	if u == nil {
+		u = s.addNewUser(who.Name, who.Subject)
+		s.ui.Update(func() {
+			s.direct.AddItems(dName(u.name))
+		})
+	}
+	u.last = time.Now()
+	learnedXKey := false
+	if xkey := xkeyFromTags(who.Tags); xkey != "" {
+		if u.xkey == "" {
+			learnedXKey = true
+		}
+		u.xkey = xkey
+	}
+	s.persistUser(u)
+
+	s.Unlock()
+
+	if learnedXKey {
+		s.replayPendingDMs(who.Subject)
+	}
+}
+
+// replayPendingDMs re-delivers any sealed DMs buffered for subject while we
+// didn't yet have their xkey to open them, now that whois has resolved it.
+func (s *state) replayPendingDMs(subject string) {
+	pending := s.takePendingDMs(subject)
+	if len(pending) == 0 {
+		return
+	}
+	dmsSub := fmt.Sprintf(dmsPub, s.me.Subject)
+	for _, data := range pending {
+		s.processNewDM(&nats.Msg{Subject: dmsSub, Data: data})
+	}
+}
@@ -29,6 +29,7 @@ func main() {
 	var server = flag.String("s", "connect.ngs.global", "NATS System")
 	var name = flag.String("n", "", "Chat Name")
 	var userCreds = flag.String("creds", "", "User Credentials File")
+	var useJS = flag.Bool("js", false, "Use JetStream for history and replay")
 
 	log.SetFlags(0)
 	flag.Usage = usage
@@ -55,12 +56,14 @@ func main() {
 	// Initialize our state
 	s := newState()
 
-	// Setup NATS and announce ourselves.
-	s.setupNATS(nc, *userCreds, *name)
-
-	// Setup terminal UI
+	// Setup terminal UI first: JetStream replay (inside setupNATS below)
+	// can deliver posts synchronously and call s.ui.Update, so the UI must
+	// exist before we touch NATS.
 	ui := s.setupUI()
 
+	// Setup NATS and announce ourselves.
+	s.setupNATS(nc, *userCreds, *name, *useJS)
+
 	// Ctrl-C to exit.
 	ui.SetKeybinding("Ctrl+C", func() { ui.Quit() })
 